@@ -0,0 +1,171 @@
+package k3s
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+const (
+	nodeTokenPath        = "/var/lib/rancher/k3s/server/node-token"
+	agentContainerSuffix = "-k3s-agent"
+)
+
+// agentConfig holds the shared configuration applied to every agent
+// container the harness launches.
+type agentConfig struct {
+	image  name.Reference
+	cpu    string
+	memory string
+	labels map[string]string
+	taints []string
+}
+
+// AgentOption configures the agent containers launched by WithAgents.
+type AgentOption func(*agentConfig) error
+
+// WithAgents configures the harness to launch n additional k3s-agent
+// containers that join the server over the harness' private network, giving
+// the cluster a real multi-node topology instead of the single-node sandbox.
+func WithAgents(n int, opts ...AgentOption) Option {
+	return func(h *Harness) error {
+		cfg := &agentConfig{}
+		for _, opt := range opts {
+			if err := opt(cfg); err != nil {
+				return fmt.Errorf("applying agent option: %w", err)
+			}
+		}
+
+		h.agentCount = n
+		h.agentConfig = cfg
+
+		return nil
+	}
+}
+
+func WithAgentImageRef(ref name.Reference) AgentOption {
+	return func(c *agentConfig) error {
+		c.image = ref
+		return nil
+	}
+}
+
+func WithAgentResources(cpu, memory string) AgentOption {
+	return func(c *agentConfig) error {
+		c.cpu = cpu
+		c.memory = memory
+		return nil
+	}
+}
+
+func WithAgentLabels(labels map[string]string) AgentOption {
+	return func(c *agentConfig) error {
+		c.labels = labels
+		return nil
+	}
+}
+
+func WithAgentTaints(taints []string) AgentOption {
+	return func(c *agentConfig) error {
+		c.taints = taints
+		return nil
+	}
+}
+
+// createAgents launches the configured number of k3s-agent containers and
+// joins them to the server over the harness' private network. It must run
+// after createServer, since it needs the server's node-token and container
+// name to join against.
+func (h *Harness) createAgents(ctx context.Context) error {
+	if h.agentCount <= 0 {
+		return nil
+	}
+
+	token, err := h.loadNodeToken(ctx)
+	if err != nil {
+		return fmt.Errorf("loading node-token: %w", err)
+	}
+	h.nodeToken = token
+
+	image := h.image
+	if h.agentConfig.image != nil {
+		image = h.agentConfig.image
+	}
+
+	for i := 0; i < h.agentCount; i++ {
+		id, err := h.createAgent(ctx, i, image)
+		if err != nil {
+			return fmt.Errorf("creating agent %d: %w", i, err)
+		}
+		h.AgentContainerIDs = append(h.AgentContainerIDs, id)
+	}
+
+	return nil
+}
+
+func (h *Harness) createAgent(ctx context.Context, idx int, image name.Reference) (string, error) {
+	name := fmt.Sprintf("%s%s-%d", h.id, agentContainerSuffix, idx)
+
+	cmd := []string{
+		"agent",
+		"--server", fmt.Sprintf("https://%s:6443", h.id+serverContainerSuffix),
+		"--token", h.nodeToken,
+	}
+	for k, v := range h.agentConfig.labels {
+		cmd = append(cmd, "--node-label", fmt.Sprintf("%s=%s", k, v))
+	}
+	for _, t := range h.agentConfig.taints {
+		cmd = append(cmd, "--node-taint", t)
+	}
+
+	res, err := containerResources(h.agentConfig.cpu, h.agentConfig.memory)
+	if err != nil {
+		return "", err
+	}
+	hostConfig := &container.HostConfig{Privileged: true, Resources: res}
+
+	resp, err := h.cli.ContainerCreate(ctx, &container.Config{
+		Image: image.Name(),
+		Cmd:   cmd,
+	}, hostConfig, &network.NetworkingConfig{}, nil, name)
+	if err != nil {
+		return "", fmt.Errorf("creating agent container: %w", err)
+	}
+
+	if err := h.cli.NetworkConnect(ctx, h.networkID, resp.ID, nil); err != nil {
+		return "", fmt.Errorf("connecting agent container to harness network: %w", err)
+	}
+
+	if err := h.cli.ContainerStart(ctx, resp.ID, container.StartOptions{}); err != nil {
+		return "", fmt.Errorf("starting agent container: %w", err)
+	}
+
+	return resp.ID, nil
+}
+
+// loadNodeToken polls for the node-token k3s generates for agents to join
+// with, since it isn't written until the server has finished coming up.
+func (h *Harness) loadNodeToken(ctx context.Context) (string, error) {
+	raw, err := h.readFileFromContainerWhenReady(ctx, h.serverContainerID, nodeTokenPath)
+	if err != nil {
+		return "", fmt.Errorf("reading node-token: %w", err)
+	}
+
+	return strings.TrimSpace(string(raw)), nil
+}
+
+// destroyAgents tears down the agent containers in reverse creation order,
+// so that whatever scheduled last onto the cluster is removed first.
+func (h *Harness) destroyAgents(ctx context.Context) error {
+	for i := len(h.AgentContainerIDs) - 1; i >= 0; i-- {
+		if err := h.removeContainer(ctx, h.AgentContainerIDs[i]); err != nil {
+			return fmt.Errorf("removing agent %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
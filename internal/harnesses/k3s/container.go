@@ -0,0 +1,343 @@
+package k3s
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/nat"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/errdefs"
+	units "github.com/docker/go-units"
+)
+
+// containerResources builds Docker resource limits from the cpu (e.g. "2",
+// "500m") and memory (e.g. "512Mi", "1g") strings accepted on the harness'
+// `agents.resources` attribute. Either may be empty to leave that limit
+// unset.
+func containerResources(cpu, memory string) (container.Resources, error) {
+	var res container.Resources
+
+	if cpu != "" {
+		nanoCPUs, err := parseNanoCPUs(cpu)
+		if err != nil {
+			return res, fmt.Errorf("invalid cpu %q: %w", cpu, err)
+		}
+		res.NanoCPUs = nanoCPUs
+	}
+
+	if memory != "" {
+		bytes, err := units.RAMInBytes(memory)
+		if err != nil {
+			return res, fmt.Errorf("invalid memory %q: %w", memory, err)
+		}
+		res.Memory = bytes
+	}
+
+	return res, nil
+}
+
+// parseNanoCPUs parses a Kubernetes-style CPU quantity ("2", "500m") into
+// Docker's nano-cpu units (1 core == 1e9).
+func parseNanoCPUs(cpu string) (int64, error) {
+	if milli, ok := strings.CutSuffix(cpu, "m"); ok {
+		n, err := strconv.ParseInt(milli, 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		return n * 1e6, nil
+	}
+
+	n, err := strconv.ParseFloat(cpu, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(n * 1e9), nil
+}
+
+const (
+	serverContainerSuffix  = "-k3s-server"
+	sandboxContainerSuffix = "-k3s-sandbox"
+	networkSuffix          = "-k3s-network"
+
+	// k3sServerPort is the port the k3s apiserver listens on inside the
+	// server container. It is published to a random host port so the
+	// rendered kubeconfig is reachable from the host.
+	k3sServerPort = "6443/tcp"
+)
+
+// createNetwork creates the bridge network private to this harness, used to
+// connect the server and sandbox containers to each other.
+func (h *Harness) createNetwork(ctx context.Context) error {
+	name := h.id + networkSuffix
+
+	resp, err := h.cli.NetworkCreate(ctx, name, types.NetworkCreate{})
+	if err != nil {
+		return fmt.Errorf("creating harness network: %w", err)
+	}
+	h.networkID = resp.ID
+
+	return nil
+}
+
+// createServer starts the k3s server container and records its container ID
+// and the host port the apiserver was published on.
+func (h *Harness) createServer(ctx context.Context) error {
+	name := h.id + serverContainerSuffix
+
+	resp, err := h.cli.ContainerCreate(ctx, &container.Config{
+		Image: h.image.Name(),
+		Cmd:   h.serverArgs(),
+		Env:   []string{"K3S_KUBECONFIG_MODE=644"},
+		ExposedPorts: nat.PortSet{
+			nat.Port(k3sServerPort): struct{}{},
+		},
+	}, &container.HostConfig{
+		Privileged: true,
+		PortBindings: nat.PortMap{
+			nat.Port(k3sServerPort): []nat.PortBinding{{HostIP: "127.0.0.1"}},
+		},
+	}, &network.NetworkingConfig{}, nil, name)
+	if err != nil {
+		return fmt.Errorf("creating server container: %w", err)
+	}
+	h.serverContainerID = resp.ID
+
+	if err := h.cli.NetworkConnect(ctx, h.networkID, h.serverContainerID, nil); err != nil {
+		return fmt.Errorf("connecting server container to harness network: %w", err)
+	}
+
+	for _, n := range h.networks {
+		if err := h.cli.NetworkConnect(ctx, n, h.serverContainerID, nil); err != nil {
+			return fmt.Errorf("connecting server container to network %q: %w", n, err)
+		}
+	}
+
+	if err := h.writeManifests(ctx); err != nil {
+		return fmt.Errorf("writing manifests: %w", err)
+	}
+
+	if err := h.cli.ContainerStart(ctx, h.serverContainerID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("starting server container: %w", err)
+	}
+
+	inspect, err := h.cli.ContainerInspect(ctx, h.serverContainerID)
+	if err != nil {
+		return fmt.Errorf("inspecting server container: %w", err)
+	}
+
+	bindings, ok := inspect.NetworkSettings.Ports[nat.Port(k3sServerPort)]
+	if !ok || len(bindings) == 0 {
+		return fmt.Errorf("server container did not publish port %s", k3sServerPort)
+	}
+	h.hostPort = bindings[0].HostPort
+
+	return nil
+}
+
+// serverArgs builds the `k3s server` invocation based on the configured
+// options.
+func (h *Harness) serverArgs() []string {
+	args := []string{"server"}
+
+	switch {
+	case h.cniType != "" && h.cniType != CNIFlannel:
+		args = append(args, "--flannel-backend=none")
+	case h.disableCni:
+		args = append(args, "--flannel-backend=none")
+	}
+
+	switch {
+	case h.ingressType != "" && h.ingressType != IngressTraefik:
+		args = append(args, "--disable=traefik")
+	case h.disableTraefik:
+		args = append(args, "--disable=traefik")
+	}
+
+	if h.disableMetricsServer {
+		args = append(args, "--disable=metrics-server")
+	}
+
+	return args
+}
+
+// createSandbox starts the sandbox container networked to the server
+// container, used to run steps against the cluster.
+func (h *Harness) createSandbox(ctx context.Context) error {
+	name := h.id + sandboxContainerSuffix
+
+	envs := make([]string, 0, len(h.sandboxEnv))
+	for k, v := range h.sandboxEnv {
+		envs = append(envs, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	resp, err := h.cli.ContainerCreate(ctx, &container.Config{
+		Image: h.sandboxImage.Name(),
+		Env:   envs,
+		Tty:   true,
+	}, &container.HostConfig{
+		Mounts: h.sandboxMounts,
+	}, &network.NetworkingConfig{}, nil, name)
+	if err != nil {
+		return fmt.Errorf("creating sandbox container: %w", err)
+	}
+	h.sandboxContainerID = resp.ID
+
+	if err := h.cli.NetworkConnect(ctx, h.networkID, h.sandboxContainerID, nil); err != nil {
+		return fmt.Errorf("connecting sandbox container to harness network: %w", err)
+	}
+
+	for _, n := range append(h.sandboxNetworks, h.networks...) {
+		if err := h.cli.NetworkConnect(ctx, n, h.sandboxContainerID, nil); err != nil {
+			return fmt.Errorf("connecting sandbox container to network %q: %w", n, err)
+		}
+	}
+
+	if err := h.cli.ContainerStart(ctx, h.sandboxContainerID, container.StartOptions{}); err != nil {
+		return fmt.Errorf("starting sandbox container: %w", err)
+	}
+
+	return nil
+}
+
+// Destroy stops and removes the sandbox and server containers along with the
+// network created for this harness. Each step tolerates the resource already
+// being gone, so Destroy is safe to call against a harness that was only
+// partially torn down (e.g. by a manual `docker rm`).
+func (h *Harness) Destroy(ctx context.Context) error {
+	if err := h.destroyAgents(ctx); err != nil {
+		return fmt.Errorf("removing agents: %w", err)
+	}
+
+	if h.sandboxContainerID != "" {
+		if err := h.removeContainer(ctx, h.sandboxContainerID); err != nil {
+			return fmt.Errorf("removing sandbox container: %w", err)
+		}
+	}
+
+	if h.serverContainerID != "" {
+		if err := h.removeContainer(ctx, h.serverContainerID); err != nil {
+			return fmt.Errorf("removing server container: %w", err)
+		}
+	}
+
+	if h.networkID != "" {
+		if err := h.cli.NetworkRemove(ctx, h.networkID); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("removing harness network: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (h *Harness) removeContainer(ctx context.Context, id string) error {
+	if err := h.cli.ContainerStop(ctx, id, container.StopOptions{}); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("stopping container: %w", err)
+	}
+
+	if err := h.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true}); err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("removing container: %w", err)
+	}
+
+	return nil
+}
+
+// Inspect checks that the server, sandbox, and agent containers backing this
+// harness are still running. It returns a non-nil error describing what is
+// missing if any of them is gone or stopped, so callers can treat the
+// harness as no longer existing.
+func (h *Harness) Inspect(ctx context.Context) error {
+	if err := h.inspectRunning(ctx, h.serverContainerID); err != nil {
+		return fmt.Errorf("k3s server: %w", err)
+	}
+
+	if err := h.inspectRunning(ctx, h.sandboxContainerID); err != nil {
+		return fmt.Errorf("sandbox: %w", err)
+	}
+
+	for i, id := range h.AgentContainerIDs {
+		if err := h.inspectRunning(ctx, id); err != nil {
+			return fmt.Errorf("agent %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// copyToContainer writes a single file named name with the given content
+// into dir inside the container identified by id. dir is created, along with
+// any missing parents, as part of the same tar stream, since it may not
+// already exist in the target image's filesystem (e.g. k3s only creates its
+// manifest auto-deploy directory on first boot).
+func (h *Harness) copyToContainer(ctx context.Context, id, dir, name string, content []byte) error {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+
+	for _, d := range parentDirs(dir) {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     strings.TrimPrefix(d, "/") + "/",
+			Typeflag: tar.TypeDir,
+			Mode:     0o755,
+		}); err != nil {
+			return fmt.Errorf("writing tar dir header: %w", err)
+		}
+	}
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name: strings.TrimPrefix(strings.TrimSuffix(dir, "/")+"/"+name, "/"),
+		Mode: 0o644,
+		Size: int64(len(content)),
+	}); err != nil {
+		return fmt.Errorf("writing tar header: %w", err)
+	}
+	if _, err := tw.Write(content); err != nil {
+		return fmt.Errorf("writing tar contents: %w", err)
+	}
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("closing tar writer: %w", err)
+	}
+
+	if err := h.cli.CopyToContainer(ctx, id, "/", buf, types.CopyToContainerOptions{}); err != nil {
+		return fmt.Errorf("copying to container: %w", err)
+	}
+
+	return nil
+}
+
+// parentDirs returns every ancestor of dir, from the root down to dir
+// itself, as absolute paths (e.g. "/var/lib/rancher/k3s/server/manifests"
+// yields "/var", "/var/lib", ..., the full path).
+func parentDirs(dir string) []string {
+	segments := strings.Split(strings.Trim(dir, "/"), "/")
+
+	dirs := make([]string, 0, len(segments))
+	cur := ""
+	for _, s := range segments {
+		if s == "" {
+			continue
+		}
+		cur += "/" + s
+		dirs = append(dirs, cur)
+	}
+
+	return dirs
+}
+
+func (h *Harness) inspectRunning(ctx context.Context, id string) error {
+	inspect, err := h.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return fmt.Errorf("container no longer exists: %w", err)
+	}
+
+	if inspect.State == nil || !inspect.State.Running {
+		return fmt.Errorf("container is not running")
+	}
+
+	return nil
+}
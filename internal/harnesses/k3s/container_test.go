@@ -0,0 +1,172 @@
+package k3s
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNanoCPUs(t *testing.T) {
+	tests := []struct {
+		name    string
+		cpu     string
+		want    int64
+		wantErr bool
+	}{
+		{name: "whole cores", cpu: "2", want: 2e9},
+		{name: "fractional cores", cpu: "0.5", want: 5e8},
+		{name: "millicpu", cpu: "500m", want: 5e8},
+		{name: "single millicpu", cpu: "1m", want: 1e6},
+		{name: "invalid millicpu", cpu: "abcm", wantErr: true},
+		{name: "invalid quantity", cpu: "abc", wantErr: true},
+		{name: "empty", cpu: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNanoCPUs(tt.cpu)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseNanoCPUs(%q) = %d, want error", tt.cpu, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseNanoCPUs(%q) returned unexpected error: %v", tt.cpu, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseNanoCPUs(%q) = %d, want %d", tt.cpu, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerResources(t *testing.T) {
+	tests := []struct {
+		name       string
+		cpu        string
+		memory     string
+		wantNano   int64
+		wantMemory int64
+		wantErr    bool
+	}{
+		{name: "both empty leaves limits unset", cpu: "", memory: ""},
+		{name: "cpu only", cpu: "2", memory: "", wantNano: 2e9},
+		{name: "memory only", cpu: "", memory: "512Mi", wantMemory: 512 * 1024 * 1024},
+		{name: "both set", cpu: "500m", memory: "1g", wantNano: 5e8, wantMemory: 1024 * 1024 * 1024},
+		{name: "invalid cpu", cpu: "nope", memory: "", wantErr: true},
+		{name: "invalid memory", cpu: "", memory: "nope", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := containerResources(tt.cpu, tt.memory)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("containerResources(%q, %q) = %+v, want error", tt.cpu, tt.memory, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("containerResources(%q, %q) returned unexpected error: %v", tt.cpu, tt.memory, err)
+			}
+			if got.NanoCPUs != tt.wantNano {
+				t.Errorf("containerResources(%q, %q).NanoCPUs = %d, want %d", tt.cpu, tt.memory, got.NanoCPUs, tt.wantNano)
+			}
+			if got.Memory != tt.wantMemory {
+				t.Errorf("containerResources(%q, %q).Memory = %d, want %d", tt.cpu, tt.memory, got.Memory, tt.wantMemory)
+			}
+		})
+	}
+}
+
+func TestParentDirs(t *testing.T) {
+	tests := []struct {
+		name string
+		dir  string
+		want []string
+	}{
+		{
+			name: "manifest dir",
+			dir:  manifestDir,
+			want: []string{"/var", "/var/lib", "/var/lib/rancher", "/var/lib/rancher/k3s", "/var/lib/rancher/k3s/server", manifestDir},
+		},
+		{name: "root only", dir: "/", want: []string{}},
+		{name: "single segment", dir: "/etc", want: []string{"/etc"}},
+		{name: "trailing slash", dir: "/etc/rancher/", want: []string{"/etc", "/etc/rancher"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parentDirs(tt.dir)
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parentDirs(%q) = %v, want %v", tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerArgs(t *testing.T) {
+	tests := []struct {
+		name string
+		h    *Harness
+		want []string
+	}{
+		{
+			name: "defaults",
+			h:    &Harness{},
+			want: []string{"server"},
+		},
+		{
+			name: "cni disabled flag",
+			h:    &Harness{disableCni: true},
+			want: []string{"server", "--flannel-backend=none"},
+		},
+		{
+			name: "non-flannel cni type",
+			h:    &Harness{cniType: CNICalico},
+			want: []string{"server", "--flannel-backend=none"},
+		},
+		{
+			name: "explicit flannel cni type is not disabled",
+			h:    &Harness{cniType: CNIFlannel},
+			want: []string{"server"},
+		},
+		{
+			name: "traefik disabled flag",
+			h:    &Harness{disableTraefik: true},
+			want: []string{"server", "--disable=traefik"},
+		},
+		{
+			name: "non-traefik ingress type",
+			h:    &Harness{ingressType: IngressNginx},
+			want: []string{"server", "--disable=traefik"},
+		},
+		{
+			name: "explicit traefik ingress type is not disabled",
+			h:    &Harness{ingressType: IngressTraefik},
+			want: []string{"server"},
+		},
+		{
+			name: "metrics server disabled",
+			h:    &Harness{disableMetricsServer: true},
+			want: []string{"server", "--disable=metrics-server"},
+		},
+		{
+			name: "everything disabled",
+			h:    &Harness{cniType: CNICilium, ingressType: IngressContour, disableMetricsServer: true},
+			want: []string{"server", "--flannel-backend=none", "--disable=traefik", "--disable=metrics-server"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.h.serverArgs()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serverArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,368 @@
+// Package k3s implements a harness that runs a k3s cluster in a Docker
+// container, alongside a sandbox container that is networked to it and used
+// to execute test steps against the cluster.
+package k3s
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/client"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// k3sKubeconfigPath is the path k3s writes its kubeconfig to inside the
+	// server container.
+	k3sKubeconfigPath = "/etc/rancher/k3s/k3s.yaml"
+
+	// defaultImage is used when no image ref is provided.
+	defaultImage = "cgr.dev/chainguard/k3s:latest"
+
+	// defaultSandboxImage is used when no sandbox image ref is provided.
+	defaultSandboxImage = "cgr.dev/chainguard/kubectl:latest-dev"
+
+	// fileReadyPollInterval is how often loadKubeconfig and loadNodeToken
+	// re-check for their target file after the server container starts. k3s
+	// needs real wall-clock time to generate certs and write these out, so a
+	// single immediate read is expected to fail on a fresh container.
+	fileReadyPollInterval = 500 * time.Millisecond
+)
+
+// StepFn is a unit of work performed against a harness.
+type StepFn func(ctx context.Context) (context.Context, error)
+
+// RegistryAuth holds registry authentication configuration for a single
+// registry, keyed by registry domain in the Harness.
+type RegistryAuth struct {
+	FromKeychain bool
+	Static       authn.AuthConfig
+}
+
+// RegistryMirror holds mirror endpoint configuration for a single registry.
+type RegistryMirror struct {
+	Endpoints []string
+}
+
+// Kubeconfig holds the rendered connection information for the cluster,
+// rewritten to point at the host-mapped server port.
+type Kubeconfig struct {
+	Raw                  string
+	Host                 string
+	ClientCertificate    string
+	ClientKey            string
+	ClusterCaCertificate string
+	Token                string
+}
+
+// Harness runs a k3s cluster in a container, with an accompanying sandbox
+// container used to run steps against it.
+type Harness struct {
+	id  string
+	cli *client.Client
+
+	image                name.Reference
+	disableCni           bool
+	disableTraefik       bool
+	disableMetricsServer bool
+
+	networks []string
+
+	registryAuth    map[string]RegistryAuth
+	registryMirrors map[string]RegistryMirror
+
+	sandboxImage    name.Reference
+	sandboxMounts   []mount.Mount
+	sandboxNetworks []string
+	sandboxEnv      map[string]string
+
+	cniType     CNIType
+	ingressType IngressType
+	manifests   []manifest
+
+	agentCount  int
+	agentConfig *agentConfig
+
+	readiness ReadinessOptions
+
+	// populated during Setup
+	networkID          string
+	serverContainerID  string
+	sandboxContainerID string
+	hostPort           string
+	nodeToken          string
+
+	// AgentContainerIDs holds the container ID of each agent launched by
+	// WithAgents, in creation order.
+	AgentContainerIDs []string
+
+	Kubeconfig *Kubeconfig
+}
+
+// Option configures a Harness.
+type Option func(*Harness) error
+
+// New creates a new k3s Harness identified by id, using cli to talk to the
+// Docker daemon.
+func New(id string, cli *client.Client, opts ...Option) (*Harness, error) {
+	image, err := name.ParseReference(defaultImage)
+	if err != nil {
+		return nil, fmt.Errorf("parsing default image reference: %w", err)
+	}
+
+	sandboxImage, err := name.ParseReference(defaultSandboxImage)
+	if err != nil {
+		return nil, fmt.Errorf("parsing default sandbox image reference: %w", err)
+	}
+
+	h := &Harness{
+		id:              id,
+		cli:             cli,
+		image:           image,
+		sandboxImage:    sandboxImage,
+		registryAuth:    make(map[string]RegistryAuth),
+		registryMirrors: make(map[string]RegistryMirror),
+		sandboxEnv:      make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		if err := opt(h); err != nil {
+			return nil, fmt.Errorf("applying option: %w", err)
+		}
+	}
+
+	return h, nil
+}
+
+func WithImageRef(ref name.Reference) Option {
+	return func(h *Harness) error {
+		h.image = ref
+		return nil
+	}
+}
+
+func WithSandboxImageRef(ref name.Reference) Option {
+	return func(h *Harness) error {
+		h.sandboxImage = ref
+		return nil
+	}
+}
+
+func WithSandboxMounts(m mount.Mount) Option {
+	return func(h *Harness) error {
+		h.sandboxMounts = append(h.sandboxMounts, m)
+		return nil
+	}
+}
+
+func WithSandboxNetworks(network string) Option {
+	return func(h *Harness) error {
+		h.sandboxNetworks = append(h.sandboxNetworks, network)
+		return nil
+	}
+}
+
+func WithSandboxEnv(env map[string]string) Option {
+	return func(h *Harness) error {
+		for k, v := range env {
+			h.sandboxEnv[k] = v
+		}
+		return nil
+	}
+}
+
+func WithCniDisabled(disabled bool) Option {
+	return func(h *Harness) error {
+		h.disableCni = disabled
+		return nil
+	}
+}
+
+func WithTraefikDisabled(disabled bool) Option {
+	return func(h *Harness) error {
+		h.disableTraefik = disabled
+		return nil
+	}
+}
+
+func WithMetricsServerDisabled(disabled bool) Option {
+	return func(h *Harness) error {
+		h.disableMetricsServer = disabled
+		return nil
+	}
+}
+
+func WithNetworks(networks ...string) Option {
+	return func(h *Harness) error {
+		h.networks = append(h.networks, networks...)
+		return nil
+	}
+}
+
+func WithAuthFromKeychain(registry string) Option {
+	return func(h *Harness) error {
+		h.registryAuth[registry] = RegistryAuth{FromKeychain: true}
+		return nil
+	}
+}
+
+func WithAuthFromStatic(registry, username, password, auth string) Option {
+	return func(h *Harness) error {
+		h.registryAuth[registry] = RegistryAuth{Static: authn.AuthConfig{
+			Username: username,
+			Password: password,
+			Auth:     auth,
+		}}
+		return nil
+	}
+}
+
+func WithRegistryMirror(registry string, endpoints ...string) Option {
+	return func(h *Harness) error {
+		m := h.registryMirrors[registry]
+		m.Endpoints = append(m.Endpoints, endpoints...)
+		h.registryMirrors[registry] = m
+		return nil
+	}
+}
+
+// Setup returns a StepFn that creates the k3s server container, the sandbox
+// container, and waits for the cluster to come up.
+func (h *Harness) Setup() StepFn {
+	return func(ctx context.Context) (context.Context, error) {
+		if err := h.createNetwork(ctx); err != nil {
+			return ctx, fmt.Errorf("creating harness network: %w", err)
+		}
+
+		if err := h.createServer(ctx); err != nil {
+			return ctx, fmt.Errorf("creating k3s server: %w", err)
+		}
+
+		if err := h.createSandbox(ctx); err != nil {
+			return ctx, fmt.Errorf("creating sandbox: %w", err)
+		}
+
+		kcfg, err := h.loadKubeconfig(ctx)
+		if err != nil {
+			return ctx, fmt.Errorf("loading kubeconfig: %w", err)
+		}
+		h.Kubeconfig = kcfg
+
+		if err := h.createAgents(ctx); err != nil {
+			return ctx, fmt.Errorf("creating agents: %w", err)
+		}
+
+		readyCtx := ctx
+		if h.readiness.Timeout > 0 {
+			var cancel context.CancelFunc
+			readyCtx, cancel = context.WithTimeout(ctx, h.readiness.Timeout)
+			defer cancel()
+		}
+
+		if err := h.waitForReady(readyCtx); err != nil {
+			return ctx, fmt.Errorf("waiting for cluster readiness: %w", err)
+		}
+
+		return ctx, nil
+	}
+}
+
+// loadKubeconfig polls for the kubeconfig k3s writes inside the server
+// container, since it isn't written until the server has generated its
+// certificates, and rewrites the server URL to point at the host-mapped port
+// so it is reachable from outside the Docker network.
+func (h *Harness) loadKubeconfig(ctx context.Context) (*Kubeconfig, error) {
+	raw, err := h.readFileFromContainerWhenReady(ctx, h.serverContainerID, k3sKubeconfigPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading kubeconfig: %w", err)
+	}
+
+	cfg, err := clientcmd.Load(raw)
+	if err != nil {
+		return nil, fmt.Errorf("parsing kubeconfig: %w", err)
+	}
+
+	for _, cluster := range cfg.Clusters {
+		cluster.Server = fmt.Sprintf("https://127.0.0.1:%s", h.hostPort)
+	}
+
+	rewritten, err := clientcmd.Write(*cfg)
+	if err != nil {
+		return nil, fmt.Errorf("rewriting kubeconfig: %w", err)
+	}
+
+	var host, clientCert, clientKey, ca, token string
+	for _, cluster := range cfg.Clusters {
+		host = cluster.Server
+		ca = string(cluster.CertificateAuthorityData)
+	}
+	for _, authInfo := range cfg.AuthInfos {
+		clientCert = string(authInfo.ClientCertificateData)
+		clientKey = string(authInfo.ClientKeyData)
+		token = authInfo.Token
+	}
+
+	return &Kubeconfig{
+		Raw:                  string(rewritten),
+		Host:                 host,
+		ClientCertificate:    clientCert,
+		ClientKey:            clientKey,
+		ClusterCaCertificate: ca,
+		Token:                token,
+	}, nil
+}
+
+// readFileFromContainerWhenReady polls CopyFromContainer for path inside the
+// container identified by id until it appears, bounded by ctx. It's used for
+// files k3s writes asynchronously after the server container starts, where a
+// single immediate read would race cert generation.
+func (h *Harness) readFileFromContainerWhenReady(ctx context.Context, id, path string) ([]byte, error) {
+	var raw []byte
+
+	err := wait.PollUntilContextCancel(ctx, fileReadyPollInterval, true, func(ctx context.Context) (bool, error) {
+		rc, _, err := h.cli.CopyFromContainer(ctx, id, path)
+		if err != nil {
+			return false, nil //nolint:nilerr // the file doesn't exist yet while the server is still coming up
+		}
+		defer rc.Close()
+
+		content, err := extractSingleFileFromTar(rc)
+		if err != nil {
+			return false, nil //nolint:nilerr // a partially-written file can fail to parse as tar
+		}
+
+		raw = content
+		return true, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for %s: %w", path, err)
+	}
+
+	return raw, nil
+}
+
+// extractSingleFileFromTar reads the first regular file out of a tar stream,
+// as returned by the Docker CopyFromContainer API.
+func extractSingleFileFromTar(r io.Reader) ([]byte, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading tar header: %w", err)
+	}
+
+	buf := &bytes.Buffer{}
+	if _, err := io.CopyN(buf, tr, hdr.Size); err != nil {
+		return nil, fmt.Errorf("reading tar contents: %w", err)
+	}
+
+	return buf.Bytes(), nil
+}
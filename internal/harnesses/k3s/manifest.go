@@ -0,0 +1,106 @@
+package k3s
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// manifestDir is where k3s auto-deploys anything it finds on startup.
+// https://docs.k3s.io/installation/packaged-components#auto-deploying-manifests
+const manifestDir = "/var/lib/rancher/k3s/server/manifests"
+
+// CNIType selects which CNI plugin the harness bootstraps.
+type CNIType string
+
+const (
+	CNIFlannel CNIType = "flannel"
+	CNICalico  CNIType = "calico"
+	CNICilium  CNIType = "cilium"
+	CNINone    CNIType = "none"
+)
+
+// IngressType selects which ingress controller the harness bootstraps.
+type IngressType string
+
+const (
+	IngressTraefik IngressType = "traefik"
+	IngressNginx   IngressType = "nginx"
+	IngressContour IngressType = "contour"
+	IngressNone    IngressType = "none"
+)
+
+// manifest is a named chunk of YAML to drop into the server's manifest
+// auto-deploy directory before it boots.
+type manifest struct {
+	name    string
+	content []byte
+}
+
+// WithManifest registers raw manifest content to be written into the k3s
+// server's auto-deploy manifest directory before it starts.
+func WithManifest(name string, content []byte) Option {
+	return func(h *Harness) error {
+		h.manifests = append(h.manifests, manifest{name: name, content: content})
+		return nil
+	}
+}
+
+// WithCNI configures the harness to bootstrap with the given CNI instead of
+// the builtin flannel. When manifestURL is set, its contents are fetched and
+// auto-deployed.
+func WithCNI(cniType CNIType, manifestURL string) Option {
+	return func(h *Harness) error {
+		h.cniType = cniType
+
+		if manifestURL == "" {
+			return nil
+		}
+
+		content, err := fetchManifest(manifestURL)
+		if err != nil {
+			return fmt.Errorf("fetching cni manifest: %w", err)
+		}
+		h.manifests = append(h.manifests, manifest{name: "cni-" + string(cniType) + ".yaml", content: content})
+
+		return nil
+	}
+}
+
+// WithIngress records the ingress controller type. Any type other than
+// traefik disables the builtin traefik at server start; the harness installs
+// no other ingress controller.
+func WithIngress(ingressType IngressType) Option {
+	return func(h *Harness) error {
+		h.ingressType = ingressType
+		return nil
+	}
+}
+
+func fetchManifest(url string) ([]byte, error) {
+	resp, err := http.Get(url) //nolint:gosec,noctx // manifest URLs are operator supplied, same trust level as the image ref
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// writeManifests copies any registered manifests into the server container's
+// auto-deploy directory. It must be called after the server container is
+// created but before it is started.
+func (h *Harness) writeManifests(ctx context.Context) error {
+	for _, m := range h.manifests {
+		if err := h.copyToContainer(ctx, h.serverContainerID, manifestDir, m.name, m.content); err != nil {
+			return fmt.Errorf("writing manifest %s: %w", m.name, err)
+		}
+	}
+
+	return nil
+}
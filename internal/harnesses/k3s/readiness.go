@@ -0,0 +1,343 @@
+package k3s
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/restmapper"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const defaultReadinessPollInterval = 2 * time.Second
+
+// componentDaemonSets maps a CNI type to the DaemonSet it installs into
+// kube-system. Flannel ships embedded in the k3s binary and isn't tracked
+// here.
+var componentDaemonSets = map[CNIType]string{
+	CNICalico: "calico-node",
+	CNICilium: "cilium",
+}
+
+// ExtraResource identifies a resource the caller wants the readiness phase
+// to additionally wait for the existence of, e.g. a CRD their test depends
+// on.
+type ExtraResource struct {
+	APIVersion string
+	Kind       string
+	Namespace  string
+	Name       string
+}
+
+// ReadinessOptions configures the readiness phase that runs after the
+// cluster's containers are up.
+type ReadinessOptions struct {
+	// Timeout bounds only the readiness phase itself, not container
+	// creation or the kubeconfig/node-token polling that precedes it. Zero
+	// means no additional bound beyond the context passed to Setup.
+	Timeout        time.Duration
+	PollInterval   time.Duration
+	ExtraResources []ExtraResource
+}
+
+// WithReadiness configures the readiness phase run at the end of Setup.
+func WithReadiness(opts ReadinessOptions) Option {
+	return func(h *Harness) error {
+		h.readiness = opts
+		return nil
+	}
+}
+
+// clientsetFromKubeconfig builds a client-go Clientset from the harness'
+// rendered kubeconfig, following the same pattern used by Terraform's own
+// kubernetes backend (clientcmd.RESTConfigFromKubeConfig + NewForConfig).
+func clientsetFromKubeconfig(raw string) (kubernetes.Interface, error) {
+	restCfg, err := clientcmd.RESTConfigFromKubeConfig([]byte(raw))
+	if err != nil {
+		return nil, fmt.Errorf("building rest config from kubeconfig: %w", err)
+	}
+
+	cs, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("building clientset: %w", err)
+	}
+
+	return cs, nil
+}
+
+// componentWorkload identifies a Deployment or DaemonSet the harness expects
+// to come up on its own, based on the options it was configured with.
+type componentWorkload struct {
+	kind      string // "Deployment" or "DaemonSet"
+	namespace string
+	name      string
+}
+
+// componentWorkloads returns the set of builtin workloads Setup should wait
+// on before considering the cluster ready.
+func (h *Harness) componentWorkloads() []componentWorkload {
+	workloads := []componentWorkload{
+		{kind: "Deployment", namespace: "kube-system", name: "coredns"},
+	}
+
+	if ds, ok := componentDaemonSets[h.cniType]; ok {
+		workloads = append(workloads, componentWorkload{kind: "DaemonSet", namespace: "kube-system", name: ds})
+	}
+
+	if !h.disableMetricsServer {
+		workloads = append(workloads, componentWorkload{kind: "Deployment", namespace: "kube-system", name: "metrics-server"})
+	}
+
+	if !h.disableTraefik && (h.ingressType == "" || h.ingressType == IngressTraefik) {
+		workloads = append(workloads, componentWorkload{kind: "Deployment", namespace: "kube-system", name: "traefik"})
+	}
+
+	return workloads
+}
+
+// waitForReady blocks until: the cluster's nodes are Ready, every builtin
+// workload the harness installed has all of its desired pods ready, the
+// default ServiceAccount exists, and any caller-supplied extra_resources
+// exist. ctx's deadline (set from the resource's `timeouts.create`) is the
+// hard ceiling on all of it.
+func (h *Harness) waitForReady(ctx context.Context) error {
+	cs, err := clientsetFromKubeconfig(h.Kubeconfig.Raw)
+	if err != nil {
+		return fmt.Errorf("building kubernetes client: %w", err)
+	}
+
+	pollInterval := h.readiness.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = defaultReadinessPollInterval
+	}
+
+	if err := waitForNodesReady(ctx, cs, pollInterval, h.agentCount+1); err != nil {
+		return fmt.Errorf("nodes: %w", err)
+	}
+
+	for _, w := range h.componentWorkloads() {
+		switch w.kind {
+		case "DaemonSet":
+			if err := waitForDaemonSetReady(ctx, cs, w.namespace, w.name); err != nil {
+				return fmt.Errorf("daemonset %s/%s: %w", w.namespace, w.name, err)
+			}
+		case "Deployment":
+			if err := waitForDeploymentReady(ctx, cs, w.namespace, w.name); err != nil {
+				return fmt.Errorf("deployment %s/%s: %w", w.namespace, w.name, err)
+			}
+		}
+	}
+
+	if err := waitForServiceAccount(ctx, cs, pollInterval, "default", "default"); err != nil {
+		return fmt.Errorf("default serviceaccount: %w", err)
+	}
+
+	if len(h.readiness.ExtraResources) > 0 {
+		restCfg, err := clientcmd.RESTConfigFromKubeConfig([]byte(h.Kubeconfig.Raw))
+		if err != nil {
+			return fmt.Errorf("building rest config from kubeconfig: %w", err)
+		}
+
+		dyn, err := dynamic.NewForConfig(restCfg)
+		if err != nil {
+			return fmt.Errorf("building dynamic client: %w", err)
+		}
+
+		for _, er := range h.readiness.ExtraResources {
+			if err := waitForExtraResource(ctx, cs.Discovery(), dyn, pollInterval, er); err != nil {
+				return fmt.Errorf("extra resource %s/%s %s/%s: %w", er.APIVersion, er.Kind, er.Namespace, er.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// waitForNodesReady polls until at least expected Nodes have registered and
+// every one of them reports conditions[Ready].Status == True. expected is
+// the server plus however many agents the harness was configured to join,
+// so that an agent which hasn't registered yet doesn't get silently skipped.
+func waitForNodesReady(ctx context.Context, cs kubernetes.Interface, pollInterval time.Duration, expected int) error {
+	return wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
+		nodes, err := cs.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return false, nil //nolint:nilerr // transient apiserver errors are expected while the cluster comes up
+		}
+
+		if len(nodes.Items) < expected {
+			return false, nil
+		}
+
+		for _, node := range nodes.Items {
+			if !nodeReady(&node) {
+				return false, nil
+			}
+		}
+
+		return true, nil
+	})
+}
+
+func nodeReady(node *corev1.Node) bool {
+	for _, cond := range node.Status.Conditions {
+		if cond.Type == corev1.NodeReady {
+			return cond.Status == corev1.ConditionTrue
+		}
+	}
+
+	return false
+}
+
+// waitForServiceAccount polls until the named ServiceAccount exists.
+func waitForServiceAccount(ctx context.Context, cs kubernetes.Interface, pollInterval time.Duration, namespace, name string) error {
+	return wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
+		_, err := cs.CoreV1().ServiceAccounts(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return false, nil
+		}
+		if err != nil {
+			return false, nil //nolint:nilerr // transient apiserver errors are expected while the cluster comes up
+		}
+
+		return true, nil
+	})
+}
+
+// waitForExtraResource polls until the resource identified by er exists.
+// The GVK is resolved to a GVR via the cluster's own discovery/REST mapper,
+// so callers can point at CRDs without the harness needing to know their
+// plural form ahead of time.
+func waitForExtraResource(ctx context.Context, disco discovery.DiscoveryInterface, dyn dynamic.Interface, pollInterval time.Duration, er ExtraResource) error {
+	gvk := schema.FromAPIVersionAndKind(er.APIVersion, er.Kind)
+
+	return wait.PollUntilContextCancel(ctx, pollInterval, true, func(ctx context.Context) (bool, error) {
+		groupResources, err := restmapper.GetAPIGroupResources(disco)
+		if err != nil {
+			return false, nil //nolint:nilerr // the target's CRD may not be registered yet
+		}
+
+		mapping, err := restmapper.NewDiscoveryRESTMapper(groupResources).RESTMapping(gvk.GroupKind(), gvk.Version)
+		if err != nil {
+			return false, nil //nolint:nilerr // the target's CRD may not be registered yet
+		}
+
+		var ri dynamic.ResourceInterface = dyn.Resource(mapping.Resource)
+		if er.Namespace != "" {
+			ri = dyn.Resource(mapping.Resource).Namespace(er.Namespace)
+		}
+
+		if _, err := ri.Get(ctx, er.Name, metav1.GetOptions{}); apierrors.IsNotFound(err) {
+			return false, nil
+		} else if err != nil {
+			return false, nil //nolint:nilerr // transient apiserver errors are expected while the cluster comes up
+		}
+
+		return true, nil
+	})
+}
+
+// waitForDaemonSetReady blocks, via a client-go informer against namespace,
+// until the DaemonSet name reports numberReady == desiredNumberScheduled.
+func waitForDaemonSetReady(ctx context.Context, cs kubernetes.Interface, namespace, name string) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0, informers.WithNamespace(namespace))
+	informer := factory.Apps().V1().DaemonSets().Informer()
+
+	// Buffered so a ready event delivered before this goroutine reaches the
+	// select below (e.g. the DaemonSet was already converged when the
+	// informer's initial List ran) is queued instead of dropped by the
+	// non-blocking send.
+	ready := make(chan struct{}, 1)
+	handler := func(obj interface{}) {
+		ds, ok := obj.(*appsv1.DaemonSet)
+		if !ok || ds.Name != name {
+			return
+		}
+		if ds.Status.DesiredNumberScheduled > 0 && ds.Status.NumberReady == ds.Status.DesiredNumberScheduled {
+			select {
+			case ready <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    handler,
+		UpdateFunc: func(_, obj interface{}) { handler(obj) },
+	}); err != nil {
+		return fmt.Errorf("registering event handler: %w", err)
+	}
+
+	go factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for informer cache sync")
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for daemonset %s/%s to be ready: %w", namespace, name, ctx.Err())
+	}
+}
+
+// waitForDeploymentReady blocks, via a client-go informer against namespace,
+// until the Deployment name reports readyReplicas == the desired replica
+// count.
+func waitForDeploymentReady(ctx context.Context, cs kubernetes.Interface, namespace, name string) error {
+	factory := informers.NewSharedInformerFactoryWithOptions(cs, 0, informers.WithNamespace(namespace))
+	informer := factory.Apps().V1().Deployments().Informer()
+
+	// Buffered so a ready event delivered before this goroutine reaches the
+	// select below (e.g. the Deployment was already converged when the
+	// informer's initial List ran) is queued instead of dropped by the
+	// non-blocking send.
+	ready := make(chan struct{}, 1)
+	handler := func(obj interface{}) {
+		d, ok := obj.(*appsv1.Deployment)
+		if !ok || d.Name != name {
+			return
+		}
+
+		desired := int32(1)
+		if d.Spec.Replicas != nil {
+			desired = *d.Spec.Replicas
+		}
+
+		if d.Status.ReadyReplicas == desired {
+			select {
+			case ready <- struct{}{}:
+			default:
+			}
+		}
+	}
+
+	if _, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    handler,
+		UpdateFunc: func(_, obj interface{}) { handler(obj) },
+	}); err != nil {
+		return fmt.Errorf("registering event handler: %w", err)
+	}
+
+	go factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), informer.HasSynced) {
+		return fmt.Errorf("timed out waiting for informer cache sync")
+	}
+
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for deployment %s/%s to be ready: %w", namespace, name, ctx.Err())
+	}
+}
@@ -0,0 +1,70 @@
+package k3s
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestComponentWorkloads(t *testing.T) {
+	coredns := componentWorkload{kind: "Deployment", namespace: "kube-system", name: "coredns"}
+	metricsServer := componentWorkload{kind: "Deployment", namespace: "kube-system", name: "metrics-server"}
+	traefik := componentWorkload{kind: "Deployment", namespace: "kube-system", name: "traefik"}
+	calico := componentWorkload{kind: "DaemonSet", namespace: "kube-system", name: "calico-node"}
+	cilium := componentWorkload{kind: "DaemonSet", namespace: "kube-system", name: "cilium"}
+
+	tests := []struct {
+		name string
+		h    *Harness
+		want []componentWorkload
+	}{
+		{
+			name: "defaults",
+			h:    &Harness{},
+			want: []componentWorkload{coredns, metricsServer, traefik},
+		},
+		{
+			name: "metrics server disabled",
+			h:    &Harness{disableMetricsServer: true},
+			want: []componentWorkload{coredns, traefik},
+		},
+		{
+			name: "traefik disabled",
+			h:    &Harness{disableTraefik: true},
+			want: []componentWorkload{coredns, metricsServer},
+		},
+		{
+			name: "non-traefik ingress type drops traefik",
+			h:    &Harness{ingressType: IngressNginx},
+			want: []componentWorkload{coredns, metricsServer},
+		},
+		{
+			name: "explicit traefik ingress type keeps traefik",
+			h:    &Harness{ingressType: IngressTraefik},
+			want: []componentWorkload{coredns, metricsServer, traefik},
+		},
+		{
+			name: "flannel has no tracked daemonset",
+			h:    &Harness{cniType: CNIFlannel},
+			want: []componentWorkload{coredns, metricsServer, traefik},
+		},
+		{
+			name: "calico adds its daemonset",
+			h:    &Harness{cniType: CNICalico},
+			want: []componentWorkload{coredns, calico, metricsServer, traefik},
+		},
+		{
+			name: "cilium adds its daemonset",
+			h:    &Harness{cniType: CNICilium},
+			want: []componentWorkload{coredns, cilium, metricsServer, traefik},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.h.componentWorkloads()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("componentWorkloads() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -7,15 +7,19 @@ import (
 	"time"
 
 	"github.com/chainguard-dev/terraform-provider-imagetest/internal/harnesses/k3s"
+	"github.com/chainguard-dev/terraform-provider-imagetest/internal/inventory"
 	"github.com/chainguard-dev/terraform-provider-imagetest/internal/log"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/hashicorp/terraform-plugin-framework-timeouts/resource/timeouts"
+	"github.com/hashicorp/terraform-plugin-framework-validators/stringvalidator"
 	"github.com/hashicorp/terraform-plugin-framework/path"
 	"github.com/hashicorp/terraform-plugin-framework/resource"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/booldefault"
+	"github.com/hashicorp/terraform-plugin-framework/resource/schema/int64default"
 	"github.com/hashicorp/terraform-plugin-framework/resource/schema/stringdefault"
+	"github.com/hashicorp/terraform-plugin-framework/schema/validator"
 	"github.com/hashicorp/terraform-plugin-framework/types"
 	"github.com/hashicorp/terraform-plugin-framework/types/basetypes"
 )
@@ -55,7 +59,54 @@ type HarnessK3sResourceModel struct {
 	Registries           map[string]RegistryResourceModel         `tfsdk:"registries"`
 	Networks             map[string]ContainerResourceModelNetwork `tfsdk:"networks"`
 	Sandbox              types.Object                             `tfsdk:"sandbox"`
+	Cni                  *HarnessK3sCniResourceModel              `tfsdk:"cni"`
+	Ingress              *HarnessK3sIngressResourceModel          `tfsdk:"ingress"`
+	Agents               *HarnessK3sAgentsResourceModel           `tfsdk:"agents"`
+	Readiness            *HarnessK3sReadinessResourceModel        `tfsdk:"readiness"`
 	Timeouts             timeouts.Value                           `tfsdk:"timeouts"`
+
+	// Connection attributes, populated after the cluster comes up so the
+	// harness can be piped straight into the kubernetes/helm providers.
+	KubeconfigRaw        types.String `tfsdk:"kubeconfig_raw"`
+	Host                 types.String `tfsdk:"host"`
+	ClientCertificate    types.String `tfsdk:"client_certificate"`
+	ClientKey            types.String `tfsdk:"client_key"`
+	ClusterCaCertificate types.String `tfsdk:"cluster_ca_certificate"`
+	Token                types.String `tfsdk:"token"`
+
+	AgentIds types.List `tfsdk:"agent_ids"`
+}
+
+// HarnessK3sAgentsResourceModel configures the additional k3s-agent
+// containers the harness joins to the server, giving the cluster a real
+// multi-node topology.
+type HarnessK3sAgentsResourceModel struct {
+	Count     types.Int64                    `tfsdk:"count"`
+	Image     types.String                   `tfsdk:"image"`
+	Resources *HarnessK3sAgentResourcesModel `tfsdk:"resources"`
+	Labels    map[string]string              `tfsdk:"labels"`
+	Taints    []string                       `tfsdk:"taints"`
+}
+
+type HarnessK3sAgentResourcesModel struct {
+	Cpu    types.String `tfsdk:"cpu"`
+	Memory types.String `tfsdk:"memory"`
+}
+
+// HarnessK3sReadinessResourceModel configures the readiness phase that gates
+// Create on the cluster's core workloads actually being up, instead of
+// returning as soon as the containers start.
+type HarnessK3sReadinessResourceModel struct {
+	Timeout        types.String                            `tfsdk:"timeout"`
+	PollInterval   types.String                            `tfsdk:"poll_interval"`
+	ExtraResources []HarnessK3sReadinessExtraResourceModel `tfsdk:"extra_resources"`
+}
+
+type HarnessK3sReadinessExtraResourceModel struct {
+	ApiVersion types.String `tfsdk:"api_version"`
+	Kind       types.String `tfsdk:"kind"`
+	Namespace  types.String `tfsdk:"namespace"`
+	Name       types.String `tfsdk:"name"`
 }
 
 type RegistryResourceModel struct {
@@ -80,6 +131,20 @@ type RegistryResourceMirrorModel struct {
 	Endpoints types.List `tfsdk:"endpoints"`
 }
 
+// HarnessK3sCniResourceModel configures the CNI the k3s harness bootstraps
+// with, in place of the builtin flannel.
+type HarnessK3sCniResourceModel struct {
+	Type        types.String `tfsdk:"type"`
+	ManifestUrl types.String `tfsdk:"manifest_url"`
+}
+
+// HarnessK3sIngressResourceModel selects the k3s harness' ingress controller
+// type. Any type other than traefik disables the builtin traefik; no other
+// ingress controller is installed.
+type HarnessK3sIngressResourceModel struct {
+	Type types.String `tfsdk:"type"`
+}
+
 type HarnessK3sSandboxResourceModel struct {
 	Image      types.String                             `tfsdk:"image"`
 	Privileged types.Bool                               `tfsdk:"privileged"`
@@ -177,6 +242,123 @@ func (r *HarnessK3sResource) Schema(ctx context.Context, req resource.SchemaRequ
 					},
 				},
 			},
+			"cni": schema.SingleNestedAttribute{
+				Description: "Configuration for the CNI the cluster bootstraps with. Defaults to the builtin flannel.",
+				Optional:    true,
+				Attributes: map[string]schema.Attribute{
+					"type": schema.StringAttribute{
+						Description: "The CNI to install. One of flannel, calico, cilium, or none.",
+						Optional:    true,
+						Computed:    true,
+						Default:     stringdefault.StaticString(string(k3s.CNIFlannel)),
+						Validators: []validator.String{
+							stringvalidator.OneOf(string(k3s.CNIFlannel), string(k3s.CNICalico), string(k3s.CNICilium), string(k3s.CNINone)),
+						},
+					},
+					"manifest_url": schema.StringAttribute{
+						Description: "A URL to the CNI's installation manifest, fetched and auto-deployed when set. When unset, no CNI manifest is installed, whatever the type.",
+						Optional:    true,
+					},
+				},
+			},
+			"ingress": schema.SingleNestedAttribute{
+				Description: "Configuration for the cluster's ingress controller. Any type other than traefik disables the builtin traefik; the harness does not install nginx or contour itself.",
+				Optional:    true,
+				Attributes: map[string]schema.Attribute{
+					"type": schema.StringAttribute{
+						Description: "The ingress controller type. One of traefik, nginx, contour, or none. With traefik, whether the builtin traefik runs is still set by disable_traefik.",
+						Optional:    true,
+						Computed:    true,
+						Default:     stringdefault.StaticString(string(k3s.IngressTraefik)),
+						Validators: []validator.String{
+							stringvalidator.OneOf(string(k3s.IngressTraefik), string(k3s.IngressNginx), string(k3s.IngressContour), string(k3s.IngressNone)),
+						},
+					},
+				},
+			},
+			"agents": schema.SingleNestedAttribute{
+				Description: "Configuration for additional k3s-agent containers joined to the server, giving the cluster a real multi-node topology.",
+				Optional:    true,
+				Attributes: map[string]schema.Attribute{
+					"count": schema.Int64Attribute{
+						Description: "The number of agent containers to join to the server.",
+						Optional:    true,
+						Computed:    true,
+						Default:     int64default.StaticInt64(0),
+					},
+					"image": schema.StringAttribute{
+						Description: "The full image reference to use for the agent containers. Defaults to the same image used for the server.",
+						Optional:    true,
+					},
+					"resources": schema.SingleNestedAttribute{
+						Description: "Resource limits applied to each agent container.",
+						Optional:    true,
+						Attributes: map[string]schema.Attribute{
+							"cpu": schema.StringAttribute{
+								Description: "The cpu limit, e.g. \"2\" or \"500m\".",
+								Optional:    true,
+							},
+							"memory": schema.StringAttribute{
+								Description: "The memory limit, e.g. \"512Mi\".",
+								Optional:    true,
+							},
+						},
+					},
+					"labels": schema.MapAttribute{
+						Description: "Node labels applied to each agent, via `--node-label`.",
+						ElementType: basetypes.StringType{},
+						Optional:    true,
+					},
+					"taints": schema.ListAttribute{
+						Description: "Node taints applied to each agent, via `--node-taint`.",
+						ElementType: basetypes.StringType{},
+						Optional:    true,
+					},
+				},
+			},
+			"agent_ids": schema.ListAttribute{
+				Description: "The Docker container IDs of the k3s-agent containers joined to the server.",
+				ElementType: basetypes.StringType{},
+				Computed:    true,
+			},
+			"readiness": schema.SingleNestedAttribute{
+				Description: "Configuration for the readiness phase that gates Create on the cluster's nodes, core workloads, and default ServiceAccount actually being up, instead of returning as soon as the containers start.",
+				Optional:    true,
+				Attributes: map[string]schema.Attribute{
+					"timeout": schema.StringAttribute{
+						Description: "The maximum time to wait for the cluster to become ready, as a Go duration string. Bounded by timeouts.create.",
+						Optional:    true,
+						Computed:    true,
+						Default:     stringdefault.StaticString("2m"),
+					},
+					"poll_interval": schema.StringAttribute{
+						Description: "How often to re-check readiness conditions, as a Go duration string.",
+						Optional:    true,
+						Computed:    true,
+						Default:     stringdefault.StaticString("2s"),
+					},
+					"extra_resources": schema.ListNestedAttribute{
+						Description: "Additional resources (e.g. CRDs a test depends on) to wait for the existence of before considering the cluster ready.",
+						Optional:    true,
+						NestedObject: schema.NestedAttributeObject{
+							Attributes: map[string]schema.Attribute{
+								"api_version": schema.StringAttribute{
+									Required: true,
+								},
+								"kind": schema.StringAttribute{
+									Required: true,
+								},
+								"namespace": schema.StringAttribute{
+									Optional: true,
+								},
+								"name": schema.StringAttribute{
+									Required: true,
+								},
+							},
+						},
+					},
+				},
+			},
 			"timeouts": timeouts.Attributes(ctx, timeouts.Opts{
 				Create:            true,
 				CreateDescription: "The maximum time to wait for the k3s harness to be created.",
@@ -196,6 +378,35 @@ func (r *HarnessK3sResource) Schema(ctx context.Context, req resource.SchemaRequ
 					},
 				),
 			},
+			"kubeconfig_raw": schema.StringAttribute{
+				Description: "The raw kubeconfig for the cluster, with the server URL rewritten to the host-mapped port so it is reachable outside of the harness' Docker network.",
+				Computed:    true,
+				Sensitive:   true,
+			},
+			"host": schema.StringAttribute{
+				Description: "The hostname (in form of URI) of the cluster's apiserver.",
+				Computed:    true,
+			},
+			"client_certificate": schema.StringAttribute{
+				Description: "PEM-encoded client certificate for TLS authentication to the cluster's apiserver.",
+				Computed:    true,
+				Sensitive:   true,
+			},
+			"client_key": schema.StringAttribute{
+				Description: "PEM-encoded client certificate key for TLS authentication to the cluster's apiserver.",
+				Computed:    true,
+				Sensitive:   true,
+			},
+			"cluster_ca_certificate": schema.StringAttribute{
+				Description: "PEM-encoded root certificates bundle for TLS authentication of the cluster's apiserver.",
+				Computed:    true,
+				Sensitive:   true,
+			},
+			"token": schema.StringAttribute{
+				Description: "The bootstrap token usable for authenticating to the cluster's apiserver in place of the client certificate.",
+				Computed:    true,
+				Sensitive:   true,
+			},
 		}),
 	}
 }
@@ -216,6 +427,15 @@ func (r *HarnessK3sResource) Create(ctx context.Context, req resource.CreateRequ
 	data.Skipped = types.BoolValue(skipped)
 
 	if data.Skipped.ValueBool() {
+		populateKubeconfigAttributes(&data, nil)
+
+		agentIds, diags := types.ListValueFrom(ctx, types.StringType, []string{})
+		resp.Diagnostics.Append(diags...)
+		if resp.Diagnostics.HasError() {
+			return
+		}
+		data.AgentIds = agentIds
+
 		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 		return
 	}
@@ -241,6 +461,79 @@ func (r *HarnessK3sResource) Create(ctx context.Context, req resource.CreateRequ
 		kopts = append(kopts, k3s.WithImageRef(ref))
 	}
 
+	if data.Cni != nil {
+		kopts = append(kopts, k3s.WithCNI(k3s.CNIType(data.Cni.Type.ValueString()), data.Cni.ManifestUrl.ValueString()))
+	}
+
+	if data.Ingress != nil {
+		kopts = append(kopts, k3s.WithIngress(k3s.IngressType(data.Ingress.Type.ValueString())))
+	}
+
+	if data.Agents != nil && data.Agents.Count.ValueInt64() > 0 {
+		var agentOpts []k3s.AgentOption
+
+		if !data.Agents.Image.IsNull() {
+			ref, err := name.ParseReference(data.Agents.Image.ValueString())
+			if err != nil {
+				resp.Diagnostics.AddError("invalid resource input", fmt.Sprintf("invalid agent image reference: %s", err))
+				return
+			}
+			agentOpts = append(agentOpts, k3s.WithAgentImageRef(ref))
+		}
+
+		if data.Agents.Resources != nil {
+			agentOpts = append(agentOpts, k3s.WithAgentResources(data.Agents.Resources.Cpu.ValueString(), data.Agents.Resources.Memory.ValueString()))
+		}
+
+		if data.Agents.Labels != nil {
+			agentOpts = append(agentOpts, k3s.WithAgentLabels(data.Agents.Labels))
+		}
+
+		if data.Agents.Taints != nil {
+			agentOpts = append(agentOpts, k3s.WithAgentTaints(data.Agents.Taints))
+		}
+
+		kopts = append(kopts, k3s.WithAgents(int(data.Agents.Count.ValueInt64()), agentOpts...))
+	}
+
+	if data.Readiness != nil {
+		var pollInterval time.Duration
+		if !data.Readiness.PollInterval.IsNull() {
+			d, err := time.ParseDuration(data.Readiness.PollInterval.ValueString())
+			if err != nil {
+				resp.Diagnostics.AddError("invalid resource input", fmt.Sprintf("invalid readiness.poll_interval: %s", err))
+				return
+			}
+			pollInterval = d
+		}
+
+		var readinessTimeout time.Duration
+		if !data.Readiness.Timeout.IsNull() {
+			d, err := time.ParseDuration(data.Readiness.Timeout.ValueString())
+			if err != nil {
+				resp.Diagnostics.AddError("invalid resource input", fmt.Sprintf("invalid readiness.timeout: %s", err))
+				return
+			}
+			readinessTimeout = d
+		}
+
+		extraResources := make([]k3s.ExtraResource, 0, len(data.Readiness.ExtraResources))
+		for _, er := range data.Readiness.ExtraResources {
+			extraResources = append(extraResources, k3s.ExtraResource{
+				APIVersion: er.ApiVersion.ValueString(),
+				Kind:       er.Kind.ValueString(),
+				Namespace:  er.Namespace.ValueString(),
+				Name:       er.Name.ValueString(),
+			})
+		}
+
+		kopts = append(kopts, k3s.WithReadiness(k3s.ReadinessOptions{
+			Timeout:        readinessTimeout,
+			PollInterval:   pollInterval,
+			ExtraResources: extraResources,
+		}))
+	}
+
 	if !data.Sandbox.IsNull() {
 		sandbox := &HarnessK3sSandboxResourceModel{}
 		resp.Diagnostics.Append(data.Sandbox.As(ctx, &sandbox, basetypes.ObjectAsOptions{})...)
@@ -344,11 +637,43 @@ func (r *HarnessK3sResource) Create(ctx context.Context, req resource.CreateRequ
 		return
 	}
 
+	populateKubeconfigAttributes(&data, harness.Kubeconfig)
+
+	agentIds, diags := types.ListValueFrom(ctx, types.StringType, harness.AgentContainerIDs)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	data.AgentIds = agentIds
+
 	// Save data into Terraform state
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
 
+// populateKubeconfigAttributes copies the connection information surfaced by
+// the k3s harness into the resource's computed attributes.
+func populateKubeconfigAttributes(data *HarnessK3sResourceModel, kcfg *k3s.Kubeconfig) {
+	if kcfg == nil {
+		data.KubeconfigRaw = types.StringNull()
+		data.Host = types.StringNull()
+		data.ClientCertificate = types.StringNull()
+		data.ClientKey = types.StringNull()
+		data.ClusterCaCertificate = types.StringNull()
+		data.Token = types.StringNull()
+		return
+	}
+
+	data.KubeconfigRaw = types.StringValue(kcfg.Raw)
+	data.Host = types.StringValue(kcfg.Host)
+	data.ClientCertificate = types.StringValue(kcfg.ClientCertificate)
+	data.ClientKey = types.StringValue(kcfg.ClientKey)
+	data.ClusterCaCertificate = types.StringValue(kcfg.ClusterCaCertificate)
+	data.Token = types.StringValue(kcfg.Token)
+}
+
 func (r *HarnessK3sResource) Read(ctx context.Context, req resource.ReadRequest, resp *resource.ReadResponse) {
+	ctx = log.WithCtx(ctx, r.store.Logger())
+
 	var data HarnessK3sResourceModel
 
 	// Read Terraform prior state data into the model
@@ -358,6 +683,39 @@ func (r *HarnessK3sResource) Read(ctx context.Context, req resource.ReadRequest,
 		return
 	}
 
+	if data.Skipped.ValueBool() {
+		resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
+		return
+	}
+
+	h, ok := r.store.harnesses.Get(data.Id.ValueString())
+	if !ok {
+		log.Warn(ctx, fmt.Sprintf("k3s harness [%s] is missing from the in-memory store, dropping from state", data.Id.ValueString()))
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	harness, ok := h.(*k3s.Harness)
+	if !ok {
+		resp.Diagnostics.AddError("invalid harness type", fmt.Sprintf("harness [%s] is not a k3s harness", data.Id.ValueString()))
+		return
+	}
+
+	if err := harness.Inspect(ctx); err != nil {
+		log.Warn(ctx, fmt.Sprintf("k3s harness [%s] failed inspection, dropping from state: %s", data.Id.ValueString(), err))
+		resp.State.RemoveResource(ctx)
+		return
+	}
+
+	populateKubeconfigAttributes(&data, harness.Kubeconfig)
+
+	agentIds, diags := types.ListValueFrom(ctx, types.StringType, harness.AgentContainerIDs)
+	resp.Diagnostics.Append(diags...)
+	if resp.Diagnostics.HasError() {
+		return
+	}
+	data.AgentIds = agentIds
+
 	// Save updated data into Terraform state
 	resp.Diagnostics.Append(resp.State.Set(ctx, &data)...)
 }
@@ -377,6 +735,8 @@ func (r *HarnessK3sResource) Update(ctx context.Context, req resource.UpdateRequ
 }
 
 func (r *HarnessK3sResource) Delete(ctx context.Context, req resource.DeleteRequest, resp *resource.DeleteResponse) {
+	ctx = log.WithCtx(ctx, r.store.Logger())
+
 	var data HarnessK3sResourceModel
 
 	// Read Terraform prior state data into the model
@@ -385,6 +745,36 @@ func (r *HarnessK3sResource) Delete(ctx context.Context, req resource.DeleteRequ
 	if resp.Diagnostics.HasError() {
 		return
 	}
+
+	if data.Skipped.ValueBool() {
+		return
+	}
+
+	h, ok := r.store.harnesses.Get(data.Id.ValueString())
+	if !ok {
+		log.Warn(ctx, fmt.Sprintf("k3s harness [%s] is missing from the in-memory store, nothing to tear down", data.Id.ValueString()))
+		return
+	}
+
+	harness, ok := h.(*k3s.Harness)
+	if !ok {
+		resp.Diagnostics.AddError("invalid harness type", fmt.Sprintf("harness [%s] is not a k3s harness", data.Id.ValueString()))
+		return
+	}
+
+	log.Info(ctx, fmt.Sprintf("destroying k3s harness [%s]", data.Id.ValueString()))
+
+	if err := harness.Destroy(ctx); err != nil {
+		resp.Diagnostics.AddError("failed to destroy harness", err.Error())
+		return
+	}
+
+	r.store.harnesses.Remove(data.Id.ValueString())
+
+	if _, err := r.store.Inventory(data.Inventory).RemoveHarness(ctx, inventory.Harness(data.Id.ValueString())); err != nil {
+		resp.Diagnostics.AddError("failed to remove harness", err.Error())
+		return
+	}
 }
 
 func (r *HarnessK3sResource) ImportState(ctx context.Context, req resource.ImportStateRequest, resp *resource.ImportStateResponse) {